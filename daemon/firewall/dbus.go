@@ -0,0 +1,220 @@
+package firewall
+
+import (
+	"fmt"
+
+	"github.com/godbus/dbus/v5"
+	"github.com/godbus/dbus/v5/introspect"
+
+	"github.com/evilsocket/opensnitch/daemon/log"
+)
+
+// D-Bus names for the firewall control service.
+const (
+	dbusObjectPath  = "/org/opensnitch/Firewall"
+	dbusIfaceName   = "org.opensnitch.Firewall"
+	dbusServiceName = "org.opensnitch.Firewall"
+)
+
+const dbusIntrospectXML = `
+<node>
+	<interface name="org.opensnitch.Firewall">
+		<method name="SetEnabled">
+			<arg direction="in" name="enabled" type="b"/>
+		</method>
+		<method name="IsEnabled">
+			<arg direction="out" name="enabled" type="b"/>
+		</method>
+		<method name="ReloadRules"/>
+		<method name="ListSystemRules">
+			<arg direction="out" name="rules" type="a(sssss)"/>
+		</method>
+		<method name="AddSystemRule">
+			<arg direction="in" name="table" type="s"/>
+			<arg direction="in" name="chain" type="s"/>
+			<arg direction="in" name="parameters" type="s"/>
+			<arg direction="in" name="target" type="s"/>
+			<arg direction="in" name="targetParameters" type="s"/>
+		</method>
+		<method name="DeleteSystemRule">
+			<arg direction="in" name="id" type="s"/>
+		</method>
+		<signal name="Changed"/>
+	</interface>` + introspect.IntrospectDataString + `</node>`
+
+// dbusService exposes firewall control over the D-Bus system bus, so
+// desktop applets and admin scripts can toggle the daemon without editing
+// config files or sending it signals.
+type dbusService struct {
+	conn *dbus.Conn
+}
+
+var dbusSvc *dbusService
+
+// StartDbusService connects to the system bus and exports the firewall
+// object. Errors are logged and swallowed: a D-Bus failure must never
+// prevent the daemon from filtering connections.
+func StartDbusService() {
+	conn, err := dbus.ConnectSystemBus()
+	if err != nil {
+		log.Warning("firewall: could not connect to the system bus: %s", err)
+		return
+	}
+
+	svc := &dbusService{conn: conn}
+	if err := conn.Export(svc, dbusObjectPath, dbusIfaceName); err != nil {
+		log.Warning("firewall: could not export D-Bus object: %s", err)
+		conn.Close()
+		return
+	}
+	if err := conn.Export(introspect.Introspectable(dbusIntrospectXML), dbusObjectPath, "org.freedesktop.DBus.Introspectable"); err != nil {
+		log.Warning("firewall: could not export D-Bus introspection: %s", err)
+	}
+
+	reply, err := conn.RequestName(dbusServiceName, dbus.NameFlagDoNotQueue)
+	if err != nil || reply != dbus.RequestNameReplyPrimaryOwner {
+		log.Warning("firewall: could not own D-Bus name %s: %s", dbusServiceName, err)
+		conn.Close()
+		return
+	}
+
+	dbusSvc = svc
+	log.Info("firewall: D-Bus service listening on %s", dbusIfaceName)
+}
+
+// StopDbusService releases the bus name and closes the connection.
+func StopDbusService() {
+	if dbusSvc == nil {
+		return
+	}
+	dbusSvc.conn.Close()
+	dbusSvc = nil
+}
+
+// errNotAuthorized is returned to callers that fail authorizeSender.
+var errNotAuthorized = dbus.NewError("org.opensnitch.Firewall.NotAuthorized", []interface{}{"only root may call this method"})
+
+// authorizeSender asks the bus daemon for the UID behind a method call and
+// only lets root through. The bus policy file (packaging/dbus/
+// org.opensnitch.Firewall.conf) restricts non-root callers to the
+// read-only methods already, this is a second, in-process check so a
+// misinstalled or missing policy file doesn't silently turn into "anyone
+// can disable the firewall".
+func (d *dbusService) authorizeSender(sender dbus.Sender) bool {
+	var uid uint32
+	call := d.conn.BusObject().Call("org.freedesktop.DBus.GetConnectionUnixUser", 0, string(sender))
+	if call.Err != nil {
+		log.Warning("firewall: could not resolve D-Bus caller %s: %s", sender, call.Err)
+		return false
+	}
+	if err := call.Store(&uid); err != nil {
+		log.Warning("firewall: could not parse D-Bus caller uid for %s: %s", sender, err)
+		return false
+	}
+	return uid == 0
+}
+
+// SetEnabled toggles the firewall on or off without stopping the daemon.
+func (d *dbusService) SetEnabled(enabled bool, sender dbus.Sender) *dbus.Error {
+	if !d.authorizeSender(sender) {
+		return errNotAuthorized
+	}
+	if enabled {
+		if !isRunning() {
+			insertRules()
+			go StartCheckingRules()
+			setRunning(true)
+		}
+	} else if isRunning() {
+		StopCheckingRules()
+		CleanRules(log.GetLogLevel() == log.DEBUG)
+		setRunning(false)
+	}
+	return nil
+}
+
+// IsEnabled reports whether the firewall rules are currently inserted.
+func (d *dbusService) IsEnabled() (bool, *dbus.Error) {
+	return isRunning(), nil
+}
+
+// ReloadRules flushes and re-inserts every rule we manage.
+func (d *dbusService) ReloadRules(sender dbus.Sender) *dbus.Error {
+	if !d.authorizeSender(sender) {
+		return errNotAuthorized
+	}
+	CleanRules(log.GetLogLevel() == log.DEBUG)
+	insertRules()
+	loadDiskConfiguration(true)
+	d.emitChanged()
+	return nil
+}
+
+// dbusSystemRule is marshalled by godbus as the (sssss) struct of
+// ListSystemRules' a(sssss) reply.
+type dbusSystemRule struct {
+	Table, Chain, Parameters, Target, TargetParameters string
+}
+
+// ListSystemRules returns the user defined system rules as
+// (table, chain, parameters, target, targetParameters) tuples.
+func (d *dbusService) ListSystemRules() ([]dbusSystemRule, *dbus.Error) {
+	rules := make([]dbusSystemRule, 0, len(fwConfig.SystemRules))
+	for _, r := range fwConfig.SystemRules {
+		rules = append(rules, dbusSystemRule{
+			r.Rule.Table,
+			r.Rule.Chain,
+			r.Rule.Parameters,
+			r.Rule.Target,
+			r.Rule.TargetParameters,
+		})
+	}
+	return rules, nil
+}
+
+// AddSystemRule inserts a new system rule into the running firewall. The
+// rule is not written to the configuration on disk.
+func (d *dbusService) AddSystemRule(table, chain, parameters, target, targetParameters string, sender dbus.Sender) *dbus.Error {
+	if !d.authorizeSender(sender) {
+		return errNotAuthorized
+	}
+	rule := &fwRule{
+		Table:            table,
+		Chain:            chain,
+		Parameters:       parameters,
+		Target:           target,
+		TargetParameters: targetParameters,
+	}
+	CreateSystemRule(rule, true)
+	if err := AddSystemRule(ADD, rule, true); err != nil {
+		return dbus.MakeFailedError(err)
+	}
+	d.emitChanged()
+	return nil
+}
+
+// DeleteSystemRule removes a previously added system rule by id.
+func (d *dbusService) DeleteSystemRule(id string, sender dbus.Sender) *dbus.Error {
+	if !d.authorizeSender(sender) {
+		return errNotAuthorized
+	}
+	for key, rule := range systemChainsSnapshot() {
+		if rule.Chain == id || key == id {
+			backend.DeleteSystemChain(rule, true)
+			d.emitChanged()
+			return nil
+		}
+	}
+	return dbus.MakeFailedError(fmt.Errorf("firewall: no system rule found with id %s", id))
+}
+
+// emitChanged notifies listeners that the set of rules was re-inserted,
+// e.g. after StartCheckingRules repaired them.
+func (d *dbusService) emitChanged() {
+	if d.conn == nil {
+		return
+	}
+	if err := d.conn.Emit(dbusObjectPath, dbusIfaceName+".Changed"); err != nil {
+		log.Warning("firewall: error emitting Changed signal: %s", err)
+	}
+}
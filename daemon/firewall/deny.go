@@ -0,0 +1,86 @@
+package firewall
+
+import "strings"
+
+// DenyMethod selects how a denied connection is actually stopped.
+type DenyMethod string
+
+const (
+	// DenyWithMark marks the packet on the queued verdict and relies on
+	// DropMarked's OUTPUT rule to drop it as it leaves the mangle table.
+	// This is the original, backend-agnostic method, and the default.
+	DenyWithMark = DenyMethod("mark-drop")
+	// DenyWithVerdictDrop is meant to return NF_DROP directly as the
+	// NFQUEUE verdict, without any DROP rule or mark round-trip through
+	// the mangle table. The queue handler that would apply this verdict
+	// lives outside this package and doesn't exist yet, so for now
+	// NeedsDropMarkRule keeps requiring the DropMarked rule under this
+	// method too rather than leaving denied connections unblocked.
+	DenyWithVerdictDrop = DenyMethod("verdict-drop")
+	// DenyWithVerdictReject is meant to behave like DenyWithVerdictDrop,
+	// but have the queue handler additionally send back a TCP RST (for
+	// TCP) or an ICMP administratively-prohibited packet (everything
+	// else), so the blocked application fails fast instead of hanging
+	// until its own connect timeout. Not wired in yet, see
+	// DenyWithVerdictDrop.
+	DenyWithVerdictReject = DenyMethod("verdict-reject")
+)
+
+// ICMP type/code used to reject non-TCP protocols under
+// DenyWithVerdictReject: type 3 is Destination Unreachable, code 13 is
+// Communication Administratively Prohibited.
+const (
+	icmpTypeDestUnreachable = 3
+	icmpCodeAdminProhibited = 13
+)
+
+// denyMethod returns the configured DenyMethod, defaulting to
+// DenyWithMark when it hasn't been set.
+func denyMethod() DenyMethod {
+	if fwConfig.DenyMethod == "" {
+		return DenyWithMark
+	}
+	return fwConfig.DenyMethod
+}
+
+// NeedsDropMarkRule reports whether the OUTPUT DROP-mark rule must be
+// installed for the currently configured deny method. insertRules/
+// CleanRules use this to only skip paying for DropMarked's mangle
+// round-trip once something else actually enforces the deny.
+//
+// That's not the case yet: DenyWithVerdictDrop/DenyWithVerdictReject are
+// decided by RejectVerdict below, but nothing in this package (or
+// anywhere else in the daemon, today) applies that verdict to the queued
+// packet, so this unconditionally requires the rule regardless of
+// DenyMethod until that queue-side integration exists. Without this, those
+// two methods would silently leave every denied connection unblocked.
+func NeedsDropMarkRule() bool {
+	return true
+}
+
+// RejectVerdict reports how the NFQUEUE verdict handler should resolve a
+// denied packet of the given protocol under the configured DenyMethod:
+// whether to drop it outright, and if a reject response should be sent, a
+// TCP RST for "tcp", or an explicit ICMP type/code (Destination
+// Unreachable / Communication Administratively Prohibited) for everything
+// else.
+//
+// No caller applies this yet (see NeedsDropMarkRule): it's the decision
+// logic the queue handler is expected to call once it exists, kept here so
+// the mapping from DenyMethod to an actual verdict doesn't have to be
+// reinvented elsewhere.
+func RejectVerdict(protocol string) (drop bool, sendTCPRST bool, icmpType int, icmpCode int) {
+	switch denyMethod() {
+	case DenyWithVerdictReject:
+		if strings.EqualFold(protocol, "tcp") {
+			return true, true, 0, 0
+		}
+		return true, false, icmpTypeDestUnreachable, icmpCodeAdminProhibited
+	case DenyWithVerdictDrop:
+		return true, false, 0, 0
+	default:
+		// DenyWithMark: the packet is marked elsewhere and dropped by
+		// the DropMarked OUTPUT rule, not by the queue verdict.
+		return false, false, 0, 0
+	}
+}
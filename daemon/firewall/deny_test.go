@@ -0,0 +1,57 @@
+package firewall
+
+import "testing"
+
+func withDenyMethod(t *testing.T, method DenyMethod, fn func()) {
+	t.Helper()
+	prev := fwConfig.DenyMethod
+	fwConfig.DenyMethod = method
+	defer func() { fwConfig.DenyMethod = prev }()
+	fn()
+}
+
+// NeedsDropMarkRule must stay true for every DenyMethod: nothing applies
+// RejectVerdict's decision to the actual NFQUEUE verdict yet, so the
+// DropMarked rule is the only thing that enforces a deny. If this ever
+// flips to false for DenyWithVerdictDrop/Reject without a queue handler
+// that applies the verdict, denied connections go through unblocked.
+func TestNeedsDropMarkRule(t *testing.T) {
+	cases := []DenyMethod{"", DenyWithMark, DenyWithVerdictDrop, DenyWithVerdictReject}
+	for _, method := range cases {
+		withDenyMethod(t, method, func() {
+			if got := NeedsDropMarkRule(); !got {
+				t.Errorf("NeedsDropMarkRule() with DenyMethod %q = %v, want true", method, got)
+			}
+		})
+	}
+}
+
+func TestRejectVerdict(t *testing.T) {
+	cases := []struct {
+		name         string
+		method       DenyMethod
+		protocol     string
+		wantDrop     bool
+		wantTCPRST   bool
+		wantICMPType int
+		wantICMPCode int
+	}{
+		{"mark-drop leaves verdict alone", DenyWithMark, "tcp", false, false, 0, 0},
+		{"verdict-drop drops without reject", DenyWithVerdictDrop, "udp", true, false, 0, 0},
+		{"verdict-reject tcp sends RST", DenyWithVerdictReject, "tcp", true, true, 0, 0},
+		{"verdict-reject tcp is case insensitive", DenyWithVerdictReject, "TCP", true, true, 0, 0},
+		{"verdict-reject udp sends ICMP", DenyWithVerdictReject, "udp", true, false, icmpTypeDestUnreachable, icmpCodeAdminProhibited},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			withDenyMethod(t, c.method, func() {
+				drop, tcpRST, icmpType, icmpCode := RejectVerdict(c.protocol)
+				if drop != c.wantDrop || tcpRST != c.wantTCPRST || icmpType != c.wantICMPType || icmpCode != c.wantICMPCode {
+					t.Errorf("RejectVerdict(%q) = (%v, %v, %d, %d), want (%v, %v, %d, %d)",
+						c.protocol, drop, tcpRST, icmpType, icmpCode,
+						c.wantDrop, c.wantTCPRST, c.wantICMPType, c.wantICMPCode)
+				}
+			})
+		})
+	}
+}
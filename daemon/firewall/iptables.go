@@ -0,0 +1,339 @@
+package firewall
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/coreos/go-iptables/iptables"
+
+	"github.com/evilsocket/opensnitch/daemon/core"
+	"github.com/evilsocket/opensnitch/daemon/log"
+)
+
+// iptablesBackend talks to the kernel via github.com/coreos/go-iptables,
+// instead of forking iptables/ip6tables per rule. It's the original
+// firewall backend, and the one detectBackend falls back to when nftables
+// isn't available.
+type iptablesBackend struct{}
+
+// serialize our own rule changes through a process-wide mutex when the
+// installed iptables doesn't support the xtables lock (--wait); only
+// --wait coordinates with other tools (docker, firewalld, ...) touching
+// xtables
+var (
+	iptWaitLock = sync.Mutex{}
+	iptWaitOnce sync.Once
+	iptWaitOK   bool
+
+	ipt4, ipt6  *iptables.IPTables
+	iptInitOnce sync.Once
+	iptInitErr  error
+
+	// regexRulesQuery and regexDropQuery match against the rulespec lines
+	// returned by go-iptables' List() (iptables -S, e.g. "-A OUTPUT -m
+	// conntrack --ctstate NEW,RELATED -j NFQUEUE --queue-num 0
+	// --queue-bypass"), not the human-readable "iptables -L -n" format.
+	regexRulesQuery, _       = regexp.Compile(`--ctstate\s+NEW,RELATED.*-j\s+NFQUEUE.*--queue-num\s+\d+.*--queue-bypass`)
+	regexDropQuery, _        = regexp.Compile(`-m\s+mark\s+--mark\s+0x18ba5\s+-j\s+DROP`)
+	regexSystemRulesQuery, _ = regexp.Compile(systemRulePrefix + ".*")
+)
+
+// Name returns the backend identifier.
+func (i *iptablesBackend) Name() BackendName {
+	return Iptables
+}
+
+// detectWaitSupport probes the installed iptables once for --wait support,
+// matching the approach moby/libnetwork uses: if the binary doesn't
+// understand --wait we can't rely on the kernel's xtables lock, so every
+// rule change is instead serialized through a process-wide mutex.
+func detectWaitSupport() bool {
+	iptWaitOnce.Do(func() {
+		_, err := core.Exec("iptables", []string{"--wait", "-L", "-n"})
+		iptWaitOK = err == nil
+		if !iptWaitOK {
+			log.Info("firewall: iptables --wait not supported, serializing rule changes")
+		}
+	})
+	return iptWaitOK
+}
+
+// clients lazily creates the IPv4 (and, if enabled, IPv6) go-iptables
+// clients, configured to use the kernel xtables lock when available.
+//
+// Only an IPv4 failure is reported back as an error: IPv4 is mandatory, but
+// IPv6 support is best-effort, so a broken/missing ip6tables degrades to
+// "IPv6 unsupported" (ipt6 stays nil, callers already check it before use)
+// instead of poisoning the whole backend the way a single shared error for
+// both would.
+func (i *iptablesBackend) clients() (*iptables.IPTables, *iptables.IPTables, error) {
+	iptInitOnce.Do(func() {
+		opts := []iptables.Option{}
+		if detectWaitSupport() {
+			opts = append(opts, iptables.Timeout(5))
+		}
+
+		ipt4, iptInitErr = iptables.New(opts...)
+		if iptInitErr != nil {
+			return
+		}
+		if core.IPv6Enabled {
+			if ipt6v, err := iptables.New(append(opts, iptables.IPv6())...); err == nil {
+				ipt6 = ipt6v
+			} else {
+				log.Warning("firewall: ip6tables unavailable, continuing with IPv4 only: %s", err)
+			}
+		}
+	})
+	return ipt4, ipt6, iptInitErr
+}
+
+// withLock runs fn while holding the fallback mutex, when the installed
+// iptables doesn't support the kernel xtables lock (--wait). When --wait
+// is supported the kernel itself serializes concurrent writers, so we
+// don't need to.
+func withLock(fn func() error) error {
+	if !detectWaitSupport() {
+		iptWaitLock.Lock()
+		defer iptWaitLock.Unlock()
+	}
+	return fn()
+}
+
+// RunRule inserts or deletes a firewall rule in the given table/chain.
+func RunRule(action Action, enable bool, logError bool, table, chain string, rulespec []string) error {
+	if enable == false {
+		action = DELETE
+	}
+
+	ipt4, ipt6, err := (&iptablesBackend{}).clients()
+	if err != nil {
+		if logError {
+			log.Error("firewall: error initializing go-iptables: %s", err)
+		}
+		return err
+	}
+
+	run := func(ipt *iptables.IPTables) error {
+		switch action {
+		case INSERT:
+			return ipt.Insert(table, chain, 1, rulespec...)
+		case ADD:
+			return ipt.AppendUnique(table, chain, rulespec...)
+		case DELETE:
+			return ipt.DeleteIfExists(table, chain, rulespec...)
+		case FLUSH:
+			return ipt.ClearChain(table, chain)
+		case NEWCHAIN:
+			return ipt.NewChain(table, chain)
+		case DELCHAIN:
+			return ipt.DeleteChain(table, chain)
+		}
+		return fmt.Errorf("firewall: unknown action %s", action)
+	}
+
+	return withLock(func() error {
+		if err := run(ipt4); err != nil {
+			if logError {
+				log.Error("Error while running firewall rule, ipv4 err: %s", err)
+				log.Error("rule: %s %s %s", table, chain, rulespec)
+			}
+			return err
+		}
+		if core.IPv6Enabled && ipt6 != nil {
+			if err := run(ipt6); err != nil {
+				if logError {
+					log.Error("Error while running firewall rule, ipv6 err: %s", err)
+					log.Error("rule: %s %s %s", table, chain, rulespec)
+				}
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// QueueDNS redirects DNS responses to us, in order to keep a cache
+// of resolved domains.
+// INPUT --protocol udp --sport 53 -j NFQUEUE --queue-num 0 --queue-bypass
+func (i *iptablesBackend) QueueDNS(enable bool, logError bool, qNum int) (err error) {
+	return RunRule(INSERT, enable, logError, "filter", "INPUT", []string{
+		"--protocol", "udp",
+		"--sport", "53",
+		"-j", "NFQUEUE",
+		"--queue-num", fmt.Sprintf("%d", qNum),
+		"--queue-bypass",
+	})
+}
+
+// QueueConnections inserts the firewall rule which redirects connections to us.
+// They are queued until the user denies/accept them, or reaches a timeout.
+// OUTPUT -t mangle -m conntrack --ctstate NEW,RELATED -j NFQUEUE --queue-num 0 --queue-bypass
+func (i *iptablesBackend) QueueConnections(enable bool, logError bool, qNum int) (err error) {
+	return RunRule(INSERT, enable, logError, "mangle", "OUTPUT", []string{
+		"-m", "conntrack",
+		"--ctstate", "NEW,RELATED",
+		"-j", "NFQUEUE",
+		"--queue-num", fmt.Sprintf("%d", qNum),
+		"--queue-bypass",
+	})
+}
+
+// DropMarked rejects packets marked by OpenSnitch.
+// OUTPUT -m mark --mark 101285 -j DROP
+func (i *iptablesBackend) DropMarked(enable bool, logError bool) (err error) {
+	return RunRule(ADD, enable, logError, "filter", "OUTPUT", []string{
+		"-m", "mark",
+		"--mark", fmt.Sprintf("%d", DropMark),
+		"-j", "DROP",
+	})
+}
+
+// CreateSystemChain create the custom firewall chains and adds them to system.
+func (i *iptablesBackend) CreateSystemChain(rule *fwRule, logErrors bool) {
+	chainName := systemRulePrefix + "-" + rule.Chain
+	if _, ok := systemChainsGet(rule.Table + "-" + chainName); ok {
+		return
+	}
+	RunRule(NEWCHAIN, true, logErrors, rule.Table, chainName, nil)
+
+	// Insert the rule at the top of the chain
+	if err := RunRule(INSERT, true, logErrors, rule.Table, rule.Chain, []string{"-j", chainName}); err == nil {
+		systemChainsSet(rule.Table+"-"+chainName, rule)
+	}
+}
+
+// DeleteSystemChain deletes the system chain created by CreateSystemChain.
+func (i *iptablesBackend) DeleteSystemChain(rule *fwRule, logErrors bool) {
+	chain := systemRulePrefix + "-" + rule.Chain
+	if _, ok := systemChainsGet(rule.Table + "-" + chain); !ok {
+		return
+	}
+	RunRule(FLUSH, true, logErrors, rule.Table, chain, nil)
+	RunRule(DELETE, false, logErrors, rule.Table, rule.Chain, []string{"-j", chain})
+	RunRule(DELCHAIN, true, logErrors, rule.Table, chain, nil)
+	systemChainsDelete(rule.Table + "-" + chain)
+}
+
+// AddSystemRule inserts a new rule.
+func (i *iptablesBackend) AddSystemRule(action Action, rule *fwRule, enable bool) (err error) {
+	chain := systemRulePrefix + "-" + rule.Chain
+	if rule.Table == "" {
+		rule.Table = "filter"
+	}
+	r := []string{}
+	if rule.Parameters != "" {
+		r = append(r, strings.Split(rule.Parameters, " ")...)
+	}
+	r = append(r, []string{"-j", rule.Target}...)
+	if rule.TargetParameters != "" {
+		r = append(r, strings.Split(rule.TargetParameters, " ")...)
+	}
+
+	return RunRule(action, enable, true, rule.Table, chain, r)
+}
+
+// AreRulesLoaded checks if the firewall rules are loaded.
+func (i *iptablesBackend) AreRulesLoaded() bool {
+	ipt4, ipt6, err := i.clients()
+	if err != nil {
+		return false
+	}
+
+	outDrop, err := ipt4.List("filter", "OUTPUT")
+	if err != nil {
+		return false
+	}
+	outMangle, err := ipt4.List("mangle", "OUTPUT")
+	if err != nil {
+		return false
+	}
+
+	var outDrop6, outMangle6 []string
+	if core.IPv6Enabled && ipt6 != nil {
+		outDrop6, err = ipt6.List("filter", "OUTPUT")
+		if err != nil {
+			return false
+		}
+		outMangle6, err = ipt6.List("mangle", "OUTPUT")
+		if err != nil {
+			return false
+		}
+	}
+
+	dropMarkLoaded := !NeedsDropMarkRule() || matchesAny(outDrop, regexDropQuery)
+
+	result := dropMarkLoaded &&
+		matchesAny(outMangle, regexRulesQuery) &&
+		systemRulesLoaded()
+
+	if core.IPv6Enabled && ipt6 != nil {
+		result = result && (!NeedsDropMarkRule() || matchesAny(outDrop6, regexDropQuery)) &&
+			matchesAny(outMangle6, regexRulesQuery)
+	}
+
+	return result
+}
+
+func matchesAny(lines []string, re *regexp.Regexp) bool {
+	for _, l := range lines {
+		if re.FindString(l) != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// systemRulesLoaded checks that every tracked system rule's chain is still
+// wired up in iptables. System rules always go through the iptables
+// backend (see nftablesBackend.AddSystemRule), regardless of which backend
+// handles the rest of the firewall, so both backends' AreRulesLoaded share
+// this check instead of looking for it in their own rule namespace.
+func systemRulesLoaded() bool {
+	ipt4, ipt6, err := (&iptablesBackend{}).clients()
+	if err != nil {
+		return len(systemChainsSnapshot()) == 0
+	}
+
+	for _, rule := range systemChainsSnapshot() {
+		if chainOut4, err4 := ipt4.List(rule.Table, rule.Chain); err4 == nil {
+			if !matchesAny(chainOut4, regexSystemRulesQuery) {
+				return false
+			}
+		}
+		if core.IPv6Enabled && ipt6 != nil {
+			if chainOut6, err6 := ipt6.List(rule.Table, rule.Chain); err6 == nil {
+				if !matchesAny(chainOut6, regexSystemRulesQuery) {
+					return false
+				}
+			}
+		}
+	}
+	return true
+}
+
+// Clean deletes the rules we added.
+func (i *iptablesBackend) Clean(logErrors bool) error {
+	i.QueueDNS(false, logErrors, queueNum)
+	i.QueueConnections(false, logErrors, queueNum)
+	if NeedsDropMarkRule() {
+		i.DropMarked(false, logErrors)
+	}
+	DeleteSystemRules(logErrors)
+	return nil
+}
+
+// isAvailable reports whether the iptables binary can be used on this host.
+func (i *iptablesBackend) isAvailable() bool {
+	_, _, err := i.clients()
+	return err == nil
+}
+
+// Watch is unsupported on the legacy iptables backend: there's no netlink
+// notification for xtables rule changes, only nftables exposes one.
+// Callers fall back to the periodic AreRulesLoaded() polling.
+func (i *iptablesBackend) Watch() (<-chan struct{}, func(), error) {
+	return nil, nil, fmt.Errorf("iptables backend has no change notifications, falling back to polling")
+}
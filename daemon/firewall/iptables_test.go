@@ -0,0 +1,45 @@
+package firewall
+
+import "testing"
+
+// These exercise regexRulesQuery/regexDropQuery against the rulespec lines
+// go-iptables' List() actually returns (iptables -S), not the human-readable
+// "iptables -L -n" format the regexes were originally written against.
+func TestRegexRulesQueryMatchesListOutput(t *testing.T) {
+	cases := []struct {
+		name string
+		line string
+		want bool
+	}{
+		{"queue rule present", `-A OUTPUT -m conntrack --ctstate NEW,RELATED -j NFQUEUE --queue-num 0 --queue-bypass`, true},
+		{"different queue num", `-A OUTPUT -m conntrack --ctstate NEW,RELATED -j NFQUEUE --queue-num 5 --queue-bypass`, true},
+		{"unrelated rule", `-A OUTPUT -j ACCEPT`, false},
+		{"missing queue-bypass", `-A OUTPUT -m conntrack --ctstate NEW,RELATED -j NFQUEUE --queue-num 0`, false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := matchesAny([]string{c.line}, regexRulesQuery); got != c.want {
+				t.Errorf("matchesAny(%q) = %v, want %v", c.line, got, c.want)
+			}
+		})
+	}
+}
+
+func TestRegexDropQueryMatchesListOutput(t *testing.T) {
+	cases := []struct {
+		name string
+		line string
+		want bool
+	}{
+		{"drop mark present", `-A OUTPUT -m mark --mark 0x18ba5 -j DROP`, true},
+		{"different mark", `-A OUTPUT -m mark --mark 0x1 -j DROP`, false},
+		{"unrelated rule", `-A OUTPUT -j ACCEPT`, false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := matchesAny([]string{c.line}, regexDropQuery); got != c.want {
+				t.Errorf("matchesAny(%q) = %v, want %v", c.line, got, c.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,71 @@
+package firewall
+
+import (
+	"github.com/evilsocket/opensnitch/daemon/log"
+)
+
+// BackendName identifies which firewall backend is in use.
+type BackendName string
+
+// Supported firewall backends.
+const (
+	Iptables = BackendName("iptables")
+	Nftables = BackendName("nftables")
+)
+
+// Provider is implemented by every firewall backend (iptables, nftables, ...).
+// rules.go drives the daemon lifecycle against whichever Provider Init()
+// selects, so the rest of the code never has to know which netfilter API is
+// actually in use.
+type Provider interface {
+	Name() BackendName
+	// QueueDNS redirects DNS responses to us via NFQUEUE.
+	QueueDNS(enable bool, logError bool, qNum int) error
+	// QueueConnections redirects new outbound connections to us via NFQUEUE.
+	QueueConnections(enable bool, logError bool, qNum int) error
+	// DropMarked drops packets previously marked as denied.
+	DropMarked(enable bool, logError bool) error
+	// AddSystemRule inserts or deletes a user defined system rule.
+	AddSystemRule(action Action, rule *fwRule, enable bool) error
+	// CreateSystemChain creates the chain/set used to hold a system rule.
+	CreateSystemChain(rule *fwRule, logErrors bool)
+	// DeleteSystemChain removes the chain/set created by CreateSystemChain.
+	DeleteSystemChain(rule *fwRule, logErrors bool)
+	// AreRulesLoaded checks if our rules are still present.
+	AreRulesLoaded() bool
+	// Clean removes every rule we've added.
+	Clean(logErrors bool) error
+	// Watch subscribes to netlink notifications of netfilter changes.
+	// It returns a channel that receives a value every time the backend's
+	// rules may have changed, and a stop function to end the subscription.
+	// Backends that have no such notification (e.g. legacy iptables)
+	// return a nil channel and an error, so callers fall back to polling.
+	Watch() (changed <-chan struct{}, stop func(), err error)
+}
+
+// backend is the currently active firewall provider, selected by Init().
+var backend Provider = &iptablesBackend{}
+
+// detectBackend picks the firewall backend to use for this host.
+//
+// If the user forced a backend via configuration it's honored as-is,
+// otherwise we prefer native nftables whenever the host accepts nftables
+// netlink requests (see nftablesBackend.isAvailable; Debian/Fedora/Arch
+// ship iptables as an nf_tables compat wrapper), and fall back to the
+// go-iptables backend everywhere else.
+func detectBackend(preferred BackendName) Provider {
+	switch preferred {
+	case Nftables:
+		return &nftablesBackend{}
+	case Iptables:
+		return &iptablesBackend{}
+	}
+
+	if nft := (&nftablesBackend{}); nft.isAvailable() {
+		log.Info("firewall: using nftables backend")
+		return nft
+	}
+
+	log.Info("firewall: using iptables backend")
+	return &iptablesBackend{}
+}
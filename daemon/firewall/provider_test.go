@@ -0,0 +1,35 @@
+package firewall
+
+import "testing"
+
+func TestDetectBackendHonorsConfiguredPreference(t *testing.T) {
+	cases := []struct {
+		name      string
+		preferred BackendName
+		want      BackendName
+	}{
+		{"forced nftables", Nftables, Nftables},
+		{"forced iptables", Iptables, Iptables},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := detectBackend(c.preferred).Name(); got != c.want {
+				t.Errorf("detectBackend(%q).Name() = %q, want %q", c.preferred, got, c.want)
+			}
+		})
+	}
+}
+
+func TestDetectBackendAutodetectFallsBackToIptables(t *testing.T) {
+	// With no preference and no nftables netlink access (usually unavailable
+	// in a test environment), detectBackend must fall back to iptables rather
+	// than returning a backend that can't do anything; with access, it picks
+	// nftables.
+	want := Iptables
+	if (&nftablesBackend{}).isAvailable() {
+		want = Nftables
+	}
+	if got := detectBackend(""); got.Name() != want {
+		t.Errorf("detectBackend(\"\").Name() = %q, want %q", got.Name(), want)
+	}
+}
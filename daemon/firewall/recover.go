@@ -0,0 +1,183 @@
+package firewall
+
+import (
+	"strings"
+
+	"github.com/evilsocket/opensnitch/daemon/core"
+	"github.com/evilsocket/opensnitch/daemon/log"
+)
+
+// HandleRecoverFlag looks for "--recover-firewall" (optionally followed by
+// "--force") in args and, if present, runs Recover and reports that it was
+// handled so the caller can exit instead of starting the daemon normally.
+//
+// This is the integration point opensnitchd's entrypoint (main.go, outside
+// this package and not part of this change) is expected to call before
+// flag.Parse() sets up the rest of the daemon's own flags, i.e.:
+//
+//	if handled, err := firewall.HandleRecoverFlag(os.Args[1:]); handled {
+//		if err != nil {
+//			log.Fatal("recover-firewall: %s", err)
+//		}
+//		return
+//	}
+func HandleRecoverFlag(args []string) (handled bool, err error) {
+	force := false
+	for _, a := range args {
+		switch a {
+		case "--recover-firewall":
+			handled = true
+		case "--force":
+			force = true
+		}
+	}
+	if !handled {
+		return false, nil
+	}
+	return true, Recover(force)
+}
+
+// Recover scans every table/chain for rules left behind by a previous,
+// uncleanly terminated instance of the daemon (the NFQUEUE rule, the
+// DropMark DROP rule, and any opensnitch-filter-* chain) and removes them.
+//
+// It works even when systemChains is empty, i.e. across process restarts
+// where the in-memory bookkeeping of which chains we created was lost:
+// without this, a killed daemon leaves the DROP-mark rule and its custom
+// chains in place, silently blocking traffic until someone hand-crafts
+// iptables commands to clean up.
+//
+// If force is false and nothing of ours is found, Recover is a no-op.
+func Recover(force bool) error {
+	log.Info("recovering firewall rules...")
+
+	found, err := scanForStaleRules()
+	if err != nil {
+		return err
+	}
+	stale := len(found) > 0
+	for _, table := range []string{"filter", "mangle"} {
+		if out, err := core.Exec("iptables-save", []string{"-t", table}); err == nil &&
+			(regexDropQuery.MatchString(out) || regexRulesQuery.MatchString(out)) {
+			stale = true
+		}
+	}
+	if !stale && !force {
+		log.Info("no stale opensnitch firewall rules found")
+		return nil
+	}
+
+	if berr := backend.Clean(true); berr != nil {
+		log.Warning("firewall: error cleaning up via %s backend: %s", backend.Name(), berr)
+	}
+
+	for _, rule := range found {
+		if err := purgeStaleChain(rule); err != nil {
+			log.Warning("firewall: error purging stale rule %s/%s: %s", rule.Table, rule.Chain, err)
+		}
+	}
+
+	if force {
+		purgeStaleDropRule()
+		purgeStaleQueueRule()
+	}
+
+	log.Info("firewall rules recovered")
+	return nil
+}
+
+// scanForStaleRules lists the filter, nat, mangle, raw and security tables
+// with iptables-save and returns
+// the opensnitch-filter-* chains found in them, regardless of whether
+// they're tracked in systemChains.
+func scanForStaleRules() ([]*fwRule, error) {
+	stale := []*fwRule{}
+
+	for _, table := range []string{"filter", "nat", "mangle", "raw", "security"} {
+		out, err := core.Exec("iptables-save", []string{"-t", table})
+		if err != nil {
+			continue
+		}
+		for _, line := range strings.Split(out, "\n") {
+			if m := regexSystemRulesQuery.FindString(line); m != "" {
+				chain := chainNameFromSave(line)
+				if chain == "" {
+					continue
+				}
+				stale = append(stale, &fwRule{Table: table, Chain: chain})
+			}
+		}
+	}
+
+	return stale, nil
+}
+
+// staleChainHooks are every base chain a system rule's jump could have
+// been installed on, across the tables scanForStaleRules checks (nat's and
+// mangle's PRE/POSTROUTING included, not just the filter table's INPUT/
+// OUTPUT/FORWARD).
+var staleChainHooks = []string{"INPUT", "OUTPUT", "FORWARD", "PREROUTING", "POSTROUTING"}
+
+// purgeStaleChain flushes, unlinks and deletes a chain left over from a
+// previous run, ignoring "no such chain" style errors since it may have
+// already been (partially) removed.
+func purgeStaleChain(rule *fwRule) error {
+	RunRule(FLUSH, true, false, rule.Table, rule.Chain, nil)
+	for _, hook := range staleChainHooks {
+		RunRule(DELETE, false, false, rule.Table, hook, []string{"-j", rule.Chain})
+	}
+	return RunRule(DELCHAIN, true, false, rule.Table, rule.Chain, nil)
+}
+
+// purgeStaleDropRule removes up to 8 copies of the DropMark DROP rule, in
+// case it was (mistakenly) inserted more than once.
+func purgeStaleDropRule() {
+	for i := 0; i < 8; i++ {
+		if err := DropMarked(false, false); err != nil {
+			break
+		}
+	}
+}
+
+// purgeStaleQueueRule removes up to 8 copies each of the NFQUEUE connection
+// and DNS rules for the configured queue-num, in case they were
+// (mistakenly) inserted more than once.
+func purgeStaleQueueRule() {
+	for i := 0; i < 8; i++ {
+		if err := QueueConnections(false, false, queueNum); err != nil {
+			break
+		}
+	}
+	for i := 0; i < 8; i++ {
+		if err := QueueDNSResponses(false, false, queueNum); err != nil {
+			break
+		}
+	}
+}
+
+// chainNameFromSave extracts a custom chain's own name from an
+// iptables-save ":name ..." declaration line, or an explicit "-N name"
+// declaration.
+//
+// It deliberately ignores "-A <base> -j name" jump lines: fields[1] there
+// is the *base* chain the rule was appended to (e.g. "OUTPUT"), not our
+// custom chain, and returning it would make callers (scanForStaleRules,
+// purgeStaleChain) flush and try to delete the user's own built-in chain.
+// The chain's declaration line already yields its name, so jump lines
+// carry nothing chainNameFromSave needs to report.
+func chainNameFromSave(line string) string {
+	if len(line) > 1 && line[0] == ':' {
+		fields := strings.Fields(line[1:])
+		if len(fields) > 0 {
+			return fields[0]
+		}
+		return ""
+	}
+	fields := strings.Fields(line)
+	for i, f := range fields {
+		if f == "-N" && i+1 < len(fields) {
+			return fields[i+1]
+		}
+	}
+	return ""
+}
@@ -0,0 +1,28 @@
+package firewall
+
+import "testing"
+
+func TestChainNameFromSave(t *testing.T) {
+	cases := []struct {
+		name string
+		line string
+		want string
+	}{
+		// The jump line must NOT yield "OUTPUT": that's the user's own
+		// built-in chain, not ours, and returning it made purgeStaleChain
+		// flush/delete it.
+		{"jump line is ignored", "-A OUTPUT -j opensnitch-filter-OUTPUT", ""},
+		{"new chain line", ":opensnitch-filter-OUTPUT - [0:0]", "opensnitch-filter-OUTPUT"},
+		{"explicit -N declaration", "-N opensnitch-filter-OUTPUT", "opensnitch-filter-OUTPUT"},
+		{"rule inside custom chain is ignored", "-A opensnitch-filter-OUTPUT -j DROP", ""},
+		{"unrelated line", "*filter", ""},
+		{"empty line", "", ""},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := chainNameFromSave(c.line); got != c.want {
+				t.Errorf("chainNameFromSave(%q) = %q, want %q", c.line, got, c.want)
+			}
+		})
+	}
+}
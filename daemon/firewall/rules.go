@@ -1,14 +1,10 @@
 package firewall
 
 import (
-	"fmt"
-	"regexp"
-	"strings"
 	"sync"
 	"time"
 
 	"github.com/fsnotify/fsnotify"
-	"github.com/evilsocket/opensnitch/daemon/core"
 	"github.com/evilsocket/opensnitch/daemon/log"
 )
 
@@ -31,215 +27,140 @@ const (
 	systemRulePrefix = "opensnitch-filter"
 )
 
-// make sure we don't mess with multiple rules
-// at the same time
 var (
-	lock = sync.Mutex{}
-
 	queueNum = 0
 	running  = false
-	// check that rules are loaded every 30s
-	rulesChecker             = time.NewTicker(time.Second * 30)
-	rulesCheckerChan         = make(chan bool)
-	regexRulesQuery, _       = regexp.Compile(`NFQUEUE.*ctstate NEW,RELATED.*NFQUEUE num.*bypass`)
-	regexDropQuery, _        = regexp.Compile(`DROP.*mark match 0x18ba5`)
-	regexSystemRulesQuery, _ = regexp.Compile(systemRulePrefix + ".*")
+	// rulesCheckerChan tells StartCheckingRules' goroutine to exit; written
+	// to by StopCheckingRules, and read again on every subsequent
+	// SetEnabled(true)/StartCheckingRules call, so it must outlive any
+	// single run (unlike the periodic ticker below).
+	rulesCheckerChan = make(chan bool)
 
 	systemChains = make(map[string]*fwRule)
+
+	// stateLock guards running and systemChains, which are read and
+	// written both from StartCheckingRules' goroutine and from the
+	// D-Bus service, where godbus dispatches every method call on its
+	// own goroutine.
+	stateLock = sync.Mutex{}
 )
 
-// RunRule inserts or deletes a firewall rule.
-func RunRule(action Action, enable bool, logError bool, rule []string) error {
-	if enable == false {
-		action = "-D"
-	}
+// isRunning is the locked equivalent of reading running directly.
+func isRunning() bool {
+	stateLock.Lock()
+	defer stateLock.Unlock()
+	return running
+}
 
-	rule = append([]string{string(action)}, rule...)
+// setRunning is the locked equivalent of writing running directly.
+func setRunning(r bool) {
+	stateLock.Lock()
+	running = r
+	stateLock.Unlock()
+}
 
-	lock.Lock()
-	defer lock.Unlock()
+// systemChainsGet returns the tracked rule for a system chain key, if any.
+func systemChainsGet(key string) (*fwRule, bool) {
+	stateLock.Lock()
+	defer stateLock.Unlock()
+	rule, ok := systemChains[key]
+	return rule, ok
+}
 
-	if _, err := core.Exec("iptables", rule); err != nil {
-		if logError {
-			log.Error("Error while running firewall rule, ipv4 err: %s", err)
-			log.Error("rule: %s", rule)
-		}
-		return err
-	}
+// systemChainsSet records a system chain as installed.
+func systemChainsSet(key string, rule *fwRule) {
+	stateLock.Lock()
+	systemChains[key] = rule
+	stateLock.Unlock()
+}
 
-	if core.IPv6Enabled {
-		if _, err := core.Exec("ip6tables", rule); err != nil {
-			if logError {
-				log.Error("Error while running firewall rule, ipv6 err: %s", err)
-				log.Error("rule: %s", rule)
-			}
-			return err
-		}
-	}
+// systemChainsDelete forgets a previously installed system chain.
+func systemChainsDelete(key string) {
+	stateLock.Lock()
+	delete(systemChains, key)
+	stateLock.Unlock()
+}
 
-	return nil
+// systemChainsSnapshot returns a point-in-time copy of systemChains, safe
+// to range over without holding stateLock for the duration of the loop.
+func systemChainsSnapshot() map[string]*fwRule {
+	stateLock.Lock()
+	defer stateLock.Unlock()
+	snapshot := make(map[string]*fwRule, len(systemChains))
+	for k, v := range systemChains {
+		snapshot[k] = v
+	}
+	return snapshot
 }
 
 // QueueDNSResponses redirects DNS responses to us, in order to keep a cache
 // of resolved domains.
-// INPUT --protocol udp --sport 53 -j NFQUEUE --queue-num 0 --queue-bypass
 func QueueDNSResponses(enable bool, logError bool, qNum int) (err error) {
-	return RunRule(INSERT, enable, logError, []string{
-		"INPUT",
-		"--protocol", "udp",
-		"--sport", "53",
-		"-j", "NFQUEUE",
-		"--queue-num", fmt.Sprintf("%d", qNum),
-		"--queue-bypass",
-	})
+	return backend.QueueDNS(enable, logError, qNum)
 }
 
 // QueueConnections inserts the firewall rule which redirects connections to us.
 // They are queued until the user denies/accept them, or reaches a timeout.
-// OUTPUT -t mangle -m conntrack --ctstate NEW,RELATED -j NFQUEUE --queue-num 0 --queue-bypass
 func QueueConnections(enable bool, logError bool, qNum int) (err error) {
-	return RunRule(INSERT, enable, logError, []string{
-		"OUTPUT",
-		"-t", "mangle",
-		"-m", "conntrack",
-		"--ctstate", "NEW,RELATED",
-		"-j", "NFQUEUE",
-		"--queue-num", fmt.Sprintf("%d", qNum),
-		"--queue-bypass",
-	})
+	return backend.QueueConnections(enable, logError, qNum)
 }
 
 // DropMarked rejects packets marked by OpenSnitch.
-// OUTPUT -m mark --mark 101285 -j DROP
 func DropMarked(enable bool, logError bool) (err error) {
-	return RunRule(ADD, enable, logError, []string{
-		"OUTPUT",
-		"-m", "mark",
-		"--mark", fmt.Sprintf("%d", DropMark),
-		"-j", "DROP",
-	})
+	return backend.DropMarked(enable, logError)
 }
 
 // CreateSystemRule create the custom firewall chains and adds them to system.
 func CreateSystemRule(rule *fwRule, logErrors bool) {
-	chainName := systemRulePrefix + "-" + rule.Chain
-	if _, ok := systemChains[rule.Table+"-"+chainName]; ok {
-		return
-	}
-	RunRule(NEWCHAIN, true, logErrors, []string{chainName, "-t", rule.Table})
-
-	// Insert the rule at the top of the chain
-	if err := RunRule(INSERT, true, logErrors, []string{rule.Chain, "-t", rule.Table, "-j", chainName}); err == nil {
-		systemChains[rule.Table+"-"+chainName] = rule
-	}
+	backend.CreateSystemChain(rule, logErrors)
 }
 
 // DeleteSystemRules deletes the system rules
 func DeleteSystemRules(logErrors bool) {
 	for _, r := range fwConfig.SystemRules {
-		chain := systemRulePrefix + "-" + r.Rule.Chain
-		if _, ok := systemChains[r.Rule.Table+"-"+chain]; !ok {
-			continue
-		}
-		RunRule(FLUSH, true, logErrors, []string{chain, "-t", r.Rule.Table})
-		RunRule(DELETE, false, logErrors, []string{r.Rule.Chain, "-t", r.Rule.Table, "-j", chain})
-		RunRule(DELCHAIN, true, logErrors, []string{chain, "-t", r.Rule.Table})
-		delete(systemChains, r.Rule.Table+"-"+chain)
+		backend.DeleteSystemChain(r.Rule, logErrors)
 	}
 }
 
 // AddSystemRule inserts a new rule.
 func AddSystemRule(action Action, rule *fwRule, enable bool) (err error) {
-	chain := systemRulePrefix + "-" + rule.Chain
-	if rule.Table == "" {
-		rule.Table = "filter"
-	}
-	r := []string{chain, "-t", rule.Table}
-	if rule.Parameters != "" {
-		r = append(r, strings.Split(rule.Parameters, " ")...)
-	}
-	r = append(r, []string{"-j", rule.Target}...)
-	if rule.TargetParameters != "" {
-		r = append(r, strings.Split(rule.TargetParameters, " ")...)
-	}
-
-	return RunRule(action, enable, true, r)
+	return backend.AddSystemRule(action, rule, enable)
 }
 
 // AreRulesLoaded checks if the firewall rules are loaded.
 func AreRulesLoaded() bool {
-	lock.Lock()
-	defer lock.Unlock()
-
-	var outDrop6 string
-	var outMangle6 string
+	return backend.AreRulesLoaded()
+}
 
-	outDrop, err := core.Exec("iptables", []string{"-n", "-L", "OUTPUT"})
-	if err != nil {
-		return false
-	}
-	outMangle, err := core.Exec("iptables", []string{"-n", "-L", "OUTPUT", "-t", "mangle"})
+// StartCheckingRules watches for netfilter changes via the backend's
+// netlink monitor, reacting within milliseconds instead of waiting for the
+// next tick, and falls back to the rulesChecker ticker as a low-frequency
+// safety net when the backend has no such notification (or we miss one).
+func StartCheckingRules() {
+	changed, stopWatch, err := backend.Watch()
 	if err != nil {
-		return false
-	}
-
-	if core.IPv6Enabled {
-		outDrop6, err = core.Exec("ip6tables", []string{"-n", "-L", "OUTPUT"})
-		if err != nil {
-			return false
-		}
-		outMangle6, err = core.Exec("ip6tables", []string{"-n", "-L", "OUTPUT", "-t", "mangle"})
-		if err != nil {
-			return false
-		}
-	}
-
-	systemRulesLoaded := true
-	if len(systemChains) > 0 {
-		for _, rule := range systemChains {
-			if chainOut4, err4 := core.Exec("iptables", []string{"-n", "-L", rule.Chain, "-t", rule.Table}); err4 == nil {
-				if regexSystemRulesQuery.FindString(chainOut4) == "" {
-					systemRulesLoaded = false
-					break
-				}
-			}
-			if core.IPv6Enabled {
-				if chainOut6, err6 := core.Exec("ip6tables", []string{"-n", "-L", rule.Chain, "-t", rule.Table}); err6 == nil {
-					if regexSystemRulesQuery.FindString(chainOut6) == "" {
-						systemRulesLoaded = false
-						break
-					}
-				}
-			}
-		}
+		log.Info("firewall: %s", err)
 	}
 
-	result := regexDropQuery.FindString(outDrop) != "" &&
-		regexRulesQuery.FindString(outMangle) != "" &&
-		systemRulesLoaded
+	// Created fresh on every call, not package-level: a time.Ticker can't
+	// be restarted once Stop() has been called, and SetEnabled(true) over
+	// D-Bus calls StartCheckingRules again after a prior SetEnabled(false)
+	// stopped it, which would otherwise leave this safety net dead for the
+	// rest of the process' life.
+	rulesChecker := time.NewTicker(time.Minute * 2)
+	defer rulesChecker.Stop()
 
-	if core.IPv6Enabled {
-		result = result && regexDropQuery.FindString(outDrop6) != "" &&
-			regexRulesQuery.FindString(outMangle6) != ""
-	}
-
-	return result
-}
-
-// StartCheckingRules checks periodically if the rules are loaded.
-// If they're not, we insert them again.
-func StartCheckingRules() {
 	for {
 		select {
 		case <-rulesCheckerChan:
+			if stopWatch != nil {
+				stopWatch()
+			}
 			goto Exit
+		case <-changed:
+			reloadRulesIfChanged("netfilter change detected")
 		case <-rulesChecker.C:
-			if rules := AreRulesLoaded(); rules == false {
-				log.Important("firewall rules changed, reloading")
-				CleanRules(log.GetLogLevel() == log.DEBUG)
-				insertRules()
-				loadDiskConfiguration(true)
-			}
+			reloadRulesIfChanged("periodic check")
 		}
 	}
 
@@ -247,23 +168,34 @@ Exit:
 	log.Info("exit checking fw rules")
 }
 
+// reloadRulesIfChanged re-inserts our rules if they're no longer loaded.
+func reloadRulesIfChanged(reason string) {
+	if rules := AreRulesLoaded(); rules == false {
+		log.Important("firewall rules changed (%s), reloading", reason)
+		CleanRules(log.GetLogLevel() == log.DEBUG)
+		insertRules()
+		loadDiskConfiguration(true)
+		if dbusSvc != nil {
+			dbusSvc.emitChanged()
+		}
+	}
+}
+
 // StopCheckingRules stops checking if the firewall rules are loaded.
 func StopCheckingRules() {
-	rulesChecker.Stop()
 	rulesCheckerChan <- true
 }
 
 // IsRunning returns if the firewall rules are loaded or not.
 func IsRunning() bool {
-	return running
+	return isRunning()
 }
 
 // CleanRules deletes the rules we added.
 func CleanRules(logErrors bool) {
-	QueueDNSResponses(false, logErrors, queueNum)
-	QueueConnections(false, logErrors, queueNum)
-	DropMarked(false, logErrors)
-	DeleteSystemRules(logErrors)
+	if err := backend.Clean(logErrors); err != nil && logErrors {
+		log.Error("Error while cleaning firewall rules: %s", err)
+	}
 }
 
 func insertRules() {
@@ -271,35 +203,43 @@ func insertRules() {
 		log.Error("Error while running DNS firewall rule: %s", err)
 	} else if err = QueueConnections(true, true, queueNum); err != nil {
 		log.Fatal("Error while running conntrack firewall rule: %s", err)
-	} else if err = DropMarked(true, true); err != nil {
-		log.Fatal("Error while running drop firewall rule: %s", err)
+	} else if NeedsDropMarkRule() {
+		if err = DropMarked(true, true); err != nil {
+			log.Fatal("Error while running drop firewall rule: %s", err)
+		}
 	}
 }
 
 // Stop deletes the firewall rules, allowing network traffic.
 func Stop(qNum *int) {
-	if running == false {
+	if !isRunning() {
 		return
 	}
 	if qNum != nil {
 		queueNum = *qNum
 	}
 
+	StopDbusService()
 	configWatcher.Close()
 	StopCheckingRules()
 	CleanRules(log.GetLogLevel() == log.DEBUG)
 
-	running = false
+	setRunning(false)
 }
 
-// Init inserts the firewall rules.
+// Init detects which firewall backend to use (iptables or nftables) and
+// inserts the firewall rules.
 func Init(qNum *int) {
-	if running {
+	if isRunning() {
 		return
 	}
 	if qNum != nil {
 		queueNum = *qNum
 	}
+
+	backend = detectBackend(fwConfig.Backend)
+	log.Info("firewall backend: %s", backend.Name())
+
 	insertRules()
 
 	if watcher, err := fsnotify.NewWatcher(); err == nil {
@@ -308,6 +248,7 @@ func Init(qNum *int) {
 	loadDiskConfiguration(false)
 
 	go StartCheckingRules()
+	go StartDbusService()
 
-	running = true
+	setRunning(true)
 }
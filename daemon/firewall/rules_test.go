@@ -0,0 +1,50 @@
+package firewall
+
+import "testing"
+
+// systemChains/running are shared between StartCheckingRules' goroutine and
+// the D-Bus service, which is why they're guarded by stateLock; these just
+// check the locked accessors behave like a plain map/bool.
+func TestSystemChainsBookkeeping(t *testing.T) {
+	defer func() {
+		for k := range systemChains {
+			delete(systemChains, k)
+		}
+	}()
+
+	if _, ok := systemChainsGet("missing"); ok {
+		t.Fatalf("systemChainsGet(missing) = ok, want not found")
+	}
+
+	rule := &fwRule{Table: "filter", Chain: "OUTPUT"}
+	systemChainsSet("filter-opensnitch-filter-OUTPUT", rule)
+
+	got, ok := systemChainsGet("filter-opensnitch-filter-OUTPUT")
+	if !ok || got != rule {
+		t.Fatalf("systemChainsGet() = %v, %v, want %v, true", got, ok, rule)
+	}
+
+	snapshot := systemChainsSnapshot()
+	if len(snapshot) != 1 || snapshot["filter-opensnitch-filter-OUTPUT"] != rule {
+		t.Fatalf("systemChainsSnapshot() = %v, want single entry %v", snapshot, rule)
+	}
+
+	systemChainsDelete("filter-opensnitch-filter-OUTPUT")
+	if _, ok := systemChainsGet("filter-opensnitch-filter-OUTPUT"); ok {
+		t.Fatalf("systemChainsGet() after delete = ok, want not found")
+	}
+}
+
+func TestRunningFlag(t *testing.T) {
+	defer setRunning(false)
+
+	setRunning(true)
+	if !isRunning() {
+		t.Fatalf("isRunning() = false after setRunning(true)")
+	}
+
+	setRunning(false)
+	if isRunning() {
+		t.Fatalf("isRunning() = true after setRunning(false)")
+	}
+}